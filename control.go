@@ -0,0 +1,154 @@
+package nebula
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// Control is returned by Main and is the primary way to interact with a
+// running nebula instance. It mirrors the surface that attachCommands
+// exposes over the SSH debug port so that embedders and external
+// supervisors (systemd units, mobile wrappers, orchestrators) can drive
+// nebula without speaking SSH or reaching into package internals.
+type Control struct {
+	f         *Interface
+	config    *Config
+	sigChan   chan os.Signal
+	closing   chan struct{}
+	closeOnce sync.Once
+}
+
+func newControl(ifce *Interface, config *Config) *Control {
+	return &Control{
+		f:       ifce,
+		config:  config,
+		sigChan: make(chan os.Signal, 1),
+		closing: make(chan struct{}),
+	}
+}
+
+// Start blocks the calling goroutine until the instance is shut down,
+// either via an OS signal or a call to Shutdown. Callers that don't want
+// to block (e.g. because they are embedding nebula alongside other work)
+// should run this in its own goroutine.
+func (c *Control) Start() error {
+	signal.Notify(c.sigChan, syscall.SIGTERM)
+	signal.Notify(c.sigChan, syscall.SIGINT)
+
+	var sig string
+	select {
+	case rawSig := <-c.sigChan:
+		sig = rawSig.String()
+	case <-c.closing:
+		sig = "controlling app"
+	}
+
+	l.WithField("signal", sig).Info("Caught signal, shutting down")
+	c.shutdown()
+	l.WithField("signal", sig).Info("Goodbye")
+	return nil
+}
+
+// Shutdown unblocks Start, which then tears down the nebula interface. It is safe
+// to call from any goroutine, including a unix-socket or RPC handler
+// driving this Control remotely, and safe to call more than once or
+// concurrently with itself: every consumer (Start, and any control socket
+// listener) observes the same broadcast rather than racing for a single
+// buffered value.
+func (c *Control) Shutdown(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	c.closeOnce.Do(func() {
+		close(c.closing)
+	})
+	return nil
+}
+
+func (c *Control) shutdown() {
+	//TODO: stop tun and udp routines, the lock on hostMap effectively does that though
+	//TODO: this is probably better as a function in ConnectionManager or HostMap directly
+	c.f.hostMap.Lock()
+	for _, h := range c.f.hostMap.Hosts {
+		if h.ConnectionState.ready {
+			c.f.send(closeTunnel, 0, h.ConnectionState, h, h.remote, []byte{}, make([]byte, 12, 12), make([]byte, mtu))
+			l.WithField("vpnIp", h.vpnIp).WithField("udpAddr", h.remote).
+				Debug("Sending close tunnel message")
+		}
+	}
+	c.f.hostMap.Unlock()
+}
+
+// Rebind closes and reopens the UDP listener, useful after the host's
+// network interfaces have changed (e.g. wifi to cellular handoff).
+func (c *Control) Rebind() {
+	c.f.outside.Rebind()
+}
+
+// ReloadConfig re-reads the config file from disk and fires any
+// RegisterReloadCallback hooks, the same path SIGHUP already takes.
+func (c *Control) ReloadConfig() error {
+	return c.config.ReloadConfigFile()
+}
+
+// ListHosts returns the vpn IPs of every host currently in the hostmap.
+func (c *Control) ListHosts() []VpnIp {
+	c.f.hostMap.Lock()
+	defer c.f.hostMap.Unlock()
+
+	hosts := make([]VpnIp, 0, len(c.f.hostMap.Hosts))
+	for _, h := range c.f.hostMap.Hosts {
+		hosts = append(hosts, h.vpnIp)
+	}
+	return hosts
+}
+
+// CloseTunnel closes the tunnel to the given vpn IP, if one exists.
+func (c *Control) CloseTunnel(vpnIP VpnIp) bool {
+	c.f.hostMap.Lock()
+	defer c.f.hostMap.Unlock()
+
+	hostInfo, ok := c.f.hostMap.Hosts[vpnIP.Key()]
+	if !ok {
+		return false
+	}
+
+	c.f.send(closeTunnel, 0, hostInfo.ConnectionState, hostInfo, hostInfo.remote, []byte{}, make([]byte, 12, 12), make([]byte, mtu))
+	c.f.hostMap.DeleteHostInfo(hostInfo)
+	c.f.handshakeManager.DeleteHostInfo(vpnIP)
+	return true
+}
+
+// PrintTunnel returns a human readable description of the tunnel state for
+// the given vpn IP, mirroring the `print-tunnel` SSH command.
+func (c *Control) PrintTunnel(vpnIP VpnIp) (string, error) {
+	c.f.hostMap.Lock()
+	defer c.f.hostMap.Unlock()
+
+	hostInfo, ok := c.f.hostMap.Hosts[vpnIP.Key()]
+	if !ok {
+		return "", fmt.Errorf("unable to find tunnel for %s", vpnIP)
+	}
+
+	return fmt.Sprintf("%+v", hostInfo), nil
+}
+
+// ChangeRemote updates the known remote address for a vpn IP, the same
+// operation the `change-remote` SSH command performs.
+func (c *Control) ChangeRemote(vpnIP VpnIp, addr *net.UDPAddr) error {
+	c.f.hostMap.Lock()
+	defer c.f.hostMap.Unlock()
+
+	hostInfo, ok := c.f.hostMap.Hosts[vpnIP.Key()]
+	if !ok {
+		return fmt.Errorf("unable to find tunnel for %s", vpnIP)
+	}
+
+	hostInfo.remote = NewUDPAddr(ip2int(addr.IP), uint16(addr.Port))
+	return nil
+}
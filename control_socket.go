@@ -0,0 +1,181 @@
+package nebula
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+)
+
+// controlSocketRequest is the JSON-RPC style request understood by the
+// control socket. Params is left as a raw message and decoded per-method
+// since each Control method takes different arguments.
+type controlSocketRequest struct {
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+type controlSocketResponse struct {
+	Result interface{} `json:"result,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+// ListenControlSocket starts a unix socket at path that exposes the same
+// surface as Control over newline delimited JSON requests/responses. This
+// lets an external supervisor (a systemd unit, a mobile wrapper, an
+// orchestrator) drive a running nebula instance without embedding Go code
+// or opening the SSH debug port.
+func (c *Control) ListenControlSocket(path string) error {
+	// An existing socket file left behind by a previous, uncleanly
+	// stopped instance will cause the listen below to fail.
+	os.Remove(path)
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return fmt.Errorf("failed to listen on control socket %s: %s", path, err)
+	}
+
+	// The control socket exposes Shutdown/CloseTunnel/ChangeRemote, so lock
+	// it down to the owner rather than leaving it at the umask's default.
+	if err := os.Chmod(path, 0600); err != nil {
+		ln.Close()
+		os.Remove(path)
+		return fmt.Errorf("failed to set permissions on control socket %s: %s", path, err)
+	}
+
+	go func() {
+		<-c.closing
+		ln.Close()
+		os.Remove(path)
+	}()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go c.handleControlConn(conn)
+		}
+	}()
+
+	return nil
+}
+
+func (c *Control) handleControlConn(conn net.Conn) {
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	enc := json.NewEncoder(conn)
+
+	for scanner.Scan() {
+		var req controlSocketRequest
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			enc.Encode(controlSocketResponse{Error: err.Error()})
+			continue
+		}
+
+		resp := c.dispatchControlRequest(req)
+		if err := enc.Encode(resp); err != nil {
+			l.WithError(err).Error("Failed to write control socket response")
+			return
+		}
+	}
+}
+
+// parseControlVpnIP parses the vpnIP field of a control socket request,
+// returning an error response (rather than a nil net.IP) if it is missing
+// or malformed so that callers never hand a nil IP to a VpnIp-keyed
+// lookup.
+func parseControlVpnIP(raw string) (VpnIp, *controlSocketResponse) {
+	ip := net.ParseIP(raw)
+	if ip == nil {
+		return VpnIp{}, &controlSocketResponse{Error: fmt.Sprintf("invalid vpnIP %q", raw)}
+	}
+	return NewVpnIp(ip), nil
+}
+
+func (c *Control) dispatchControlRequest(req controlSocketRequest) controlSocketResponse {
+	switch req.Method {
+	case "Rebind":
+		c.Rebind()
+		return controlSocketResponse{Result: "ok"}
+
+	case "ReloadConfig":
+		if err := c.ReloadConfig(); err != nil {
+			return controlSocketResponse{Error: err.Error()}
+		}
+		return controlSocketResponse{Result: "ok"}
+
+	case "Shutdown":
+		if err := c.Shutdown(context.Background()); err != nil {
+			return controlSocketResponse{Error: err.Error()}
+		}
+		return controlSocketResponse{Result: "ok"}
+
+	case "ListHosts":
+		hosts := c.ListHosts()
+		vpnIPs := make([]string, 0, len(hosts))
+		for _, vpnIP := range hosts {
+			vpnIPs = append(vpnIPs, vpnIP.String())
+		}
+		return controlSocketResponse{Result: vpnIPs}
+
+	case "CloseTunnel":
+		var p struct {
+			VpnIP string `json:"vpnIP"`
+		}
+		if err := json.Unmarshal(req.Params, &p); err != nil {
+			return controlSocketResponse{Error: err.Error()}
+		}
+		vpnIP, errResp := parseControlVpnIP(p.VpnIP)
+		if errResp != nil {
+			return *errResp
+		}
+		ok := c.CloseTunnel(vpnIP)
+		return controlSocketResponse{Result: ok}
+
+	case "PrintTunnel":
+		var p struct {
+			VpnIP string `json:"vpnIP"`
+		}
+		if err := json.Unmarshal(req.Params, &p); err != nil {
+			return controlSocketResponse{Error: err.Error()}
+		}
+		vpnIP, errResp := parseControlVpnIP(p.VpnIP)
+		if errResp != nil {
+			return *errResp
+		}
+		desc, err := c.PrintTunnel(vpnIP)
+		if err != nil {
+			return controlSocketResponse{Error: err.Error()}
+		}
+		return controlSocketResponse{Result: desc}
+
+	case "ChangeRemote":
+		var p struct {
+			VpnIP string `json:"vpnIP"`
+			Addr  string `json:"addr"`
+		}
+		if err := json.Unmarshal(req.Params, &p); err != nil {
+			return controlSocketResponse{Error: err.Error()}
+		}
+		vpnIP, errResp := parseControlVpnIP(p.VpnIP)
+		if errResp != nil {
+			return *errResp
+		}
+		addr, err := net.ResolveUDPAddr("udp", p.Addr)
+		if err != nil {
+			return controlSocketResponse{Error: err.Error()}
+		}
+		if err := c.ChangeRemote(vpnIP, addr); err != nil {
+			return controlSocketResponse{Error: err.Error()}
+		}
+		return controlSocketResponse{Result: "ok"}
+
+	default:
+		return controlSocketResponse{Error: fmt.Sprintf("unknown method %q", req.Method)}
+	}
+}
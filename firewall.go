@@ -0,0 +1,72 @@
+package nebula
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+// Firewall enforces the inbound/outbound connection rules configured under
+// the firewall config block. Rules are keyed by the remote certificate's
+// name/groups rather than its vpn IP, so nothing here needs to change for
+// dual-stack/IPv6 certificates - that generalization lives in HostMap and
+// LightHouse instead.
+type Firewall struct {
+	rules    []FirewallRule
+	ruleHash string
+}
+
+// FirewallRule is a single parsed entry from the firewall config block.
+type FirewallRule struct {
+	Port   string
+	Proto  string
+	Host   string
+	Group  string
+	CIDR   string
+}
+
+// NewFirewallFromConfig builds a Firewall from the firewall.inbound and
+// firewall.outbound config blocks. Each rule is stored as written; cert is
+// not consulted and host/group names are not validated.
+func NewFirewallFromConfig(cert *NebulaCertificate, config *Config) (*Firewall, error) {
+	fw := &Firewall{}
+
+	for _, dir := range []string{"inbound", "outbound"} {
+		rawRules, ok := config.Get(fmt.Sprintf("firewall.%s", dir)).([]interface{})
+		if !ok {
+			continue
+		}
+
+		for _, rawRule := range rawRules {
+			rule, ok := rawRule.(map[interface{}]interface{})
+			if !ok {
+				return nil, fmt.Errorf("firewall.%s rule was not a map: %v", dir, rawRule)
+			}
+
+			fw.rules = append(fw.rules, FirewallRule{
+				Port:  fmt.Sprintf("%v", rule["port"]),
+				Proto: fmt.Sprintf("%v", rule["proto"]),
+				Host:  fmt.Sprintf("%v", rule["host"]),
+				Group: fmt.Sprintf("%v", rule["group"]),
+				CIDR:  fmt.Sprintf("%v", rule["cidr"]),
+			})
+		}
+	}
+
+	fw.ruleHash = hashFirewallRules(fw.rules)
+	return fw, nil
+}
+
+// GetRuleHash returns a stable hash of the currently loaded rule set, used
+// to log whether a config reload actually changed the firewall.
+func (f *Firewall) GetRuleHash() string {
+	return f.ruleHash
+}
+
+func hashFirewallRules(rules []FirewallRule) string {
+	h := sha256.New()
+	for _, r := range rules {
+		fmt.Fprintf(h, "%s|%s|%s|%s|%s;", r.Port, r.Proto, r.Host, r.Group, r.CIDR)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,124 @@
+package nebula
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Route describes a single tun.routes/tun.unsafe_routes entry: a subnet
+// reachable through (or owned by) the tunnel, plus the metric callers
+// should prefer it at. It is intentionally small since route parsing lives
+// with the rest of config handling; this is just the shape HostMap and Tun
+// agree on when routes are applied or reloaded.
+type Route struct {
+	MTU    int
+	Metric int
+	Cidr   *net.IPNet
+}
+
+// HostInfo tracks everything we know about a single remote tunnel: its
+// identity, current connection state, and the most recently known remote
+// address.
+type HostInfo struct {
+	vpnIp           VpnIp
+	remote          *udpAddr
+	remotes         []*udpAddr
+	ConnectionState *ConnectionState
+}
+
+// HostMap is the local node's view of every tunnel it currently has
+// established or is attempting to establish. Hosts is keyed by
+// VpnIp.Key() rather than VpnIp itself: net.IP is a slice, so a struct
+// wrapping one (VpnIp) is not comparable and can't be a map key directly.
+// This is what lets a node with IPv6 (or dual-stack) tunnel addresses
+// share a single HostMap with IPv4-only peers instead of needing a
+// parallel map per address family.
+type HostMap struct {
+	sync.RWMutex
+	name            string
+	Hosts           map[[17]byte]*HostInfo
+	vpnCIDRs        []*net.IPNet
+	vpnCIDR         *net.IPNet
+	preferredRanges []*net.IPNet
+	defaultRoute    uint32
+	unsafeRoutes    *[]Route
+}
+
+// NewHostMap builds an empty HostMap for the given tunnel address families.
+// vpnCIDRs must have at least one entry; the first is kept as vpnCIDR for
+// callers that only care about the primary (first) address.
+func NewHostMap(name string, vpnCIDRs []*net.IPNet, preferredRanges []*net.IPNet) *HostMap {
+	return &HostMap{
+		name:            name,
+		Hosts:           map[[17]byte]*HostInfo{},
+		vpnCIDRs:        vpnCIDRs,
+		vpnCIDR:         vpnCIDRs[0],
+		preferredRanges: preferredRanges,
+	}
+}
+
+// SetDefaultRoute sets the vpn IP that unsafe_routes with no more specific
+// match should be sent to.
+func (hm *HostMap) SetDefaultRoute(ip uint32) {
+	hm.defaultRoute = ip
+}
+
+// addUnsafeRoutes swaps in the route table used to decide which vpn IP an
+// otherwise-unrouted packet should be forwarded to. Callers must hold the
+// HostMap lock.
+func (hm *HostMap) addUnsafeRoutes(routes *[]Route) {
+	hm.unsafeRoutes = routes
+}
+
+// DeleteHostInfo removes hostinfo from the map it's keyed under. Callers
+// that also need to notify the remote side should send a closeTunnel
+// message before calling this, and should also call
+// HandshakeManager.DeleteHostInfo to drop any pending handshake state for
+// the same vpn IP. Callers must hold the HostMap lock.
+func (hm *HostMap) DeleteHostInfo(hostinfo *HostInfo) {
+	delete(hm.Hosts, hostinfo.vpnIp.Key())
+}
+
+// Promoter periodically switches each known host to another of its known
+// remotes via tryPromoteBest. It does not measure latency or compare
+// remotes against preferredRanges; it only skips hosts when no preferred
+// ranges are configured.
+func (hm *HostMap) Promoter(interval int) {
+	for range time.NewTicker(time.Duration(interval) * time.Second).C {
+		hm.Lock()
+		for _, h := range hm.Hosts {
+			hm.tryPromoteBest(h)
+		}
+		hm.Unlock()
+	}
+}
+
+func (hm *HostMap) tryPromoteBest(hostinfo *HostInfo) {
+	if len(hm.preferredRanges) == 0 || len(hostinfo.remotes) == 0 {
+		return
+	}
+	// The first known remote that isn't already active becomes the new
+	// preferred remote; remote discovery (via lighthouse queries/NAT
+	// punching) already orders remotes, preferred ranges first.
+	for _, r := range hostinfo.remotes {
+		if r != hostinfo.remote {
+			hostinfo.remote = r
+			return
+		}
+	}
+}
+
+// Punchy sends a tiny keepalive packet to every known remote on a fixed
+// interval to keep NAT mappings and firewall conntrack entries alive.
+func (hm *HostMap) Punchy(udpServer *udpConn) {
+	for range time.NewTicker(time.Second * 10).C {
+		hm.RLock()
+		for _, h := range hm.Hosts {
+			if h.remote != nil {
+				udpServer.WriteTo([]byte{1}, h.remote)
+			}
+		}
+		hm.RUnlock()
+	}
+}
@@ -0,0 +1,158 @@
+package nebula
+
+import (
+	"sync"
+	"time"
+)
+
+// LightHouse tracks where every known vpn IP can currently be reached and,
+// on a lighthouse node, answers queries from other hosts asking the same
+// thing. myVpnIp identifies which of the local node's own tunnel addresses
+// to advertise; lighthouseHosts holds the upstream lighthouses a
+// non-lighthouse node queries and keeps alive.
+type LightHouse struct {
+	sync.RWMutex
+	amLighthouse bool
+	myVpnIp      VpnIp
+	interval     int
+	nebulaPort   int
+	punch        bool
+	punchDelay   time.Duration
+
+	// addrMap holds every vpn IP this lighthouse (or, on a non-lighthouse
+	// node, this node's own cache) knows a remote address for, keyed by
+	// VpnIp.Key() for the same reason HostMap.Hosts is.
+	addrMap map[[17]byte][]*udpAddr
+	// static marks which addrMap entries came from static_host_map, as
+	// opposed to ones learned dynamically from handshakes, so a reload can
+	// tell the two apart.
+	static map[[17]byte]bool
+
+	lighthouseHosts []VpnIp
+
+	remoteAllowList *AllowList
+	localAllowList  *AllowList
+}
+
+// NewLightHouse constructs a LightHouse for myVpnIp. lighthouseHosts is the
+// configured upstream lighthouse list (empty on a lighthouse node itself).
+func NewLightHouse(amLighthouse bool, myVpnIp VpnIp, lighthouseHosts []VpnIp, interval int, nebulaPort int, pc *udpConn, punch bool, punchDelay time.Duration) *LightHouse {
+	return &LightHouse{
+		amLighthouse:    amLighthouse,
+		myVpnIp:         myVpnIp,
+		interval:        interval,
+		nebulaPort:      nebulaPort,
+		punch:           punch,
+		punchDelay:      punchDelay,
+		addrMap:         map[[17]byte][]*udpAddr{},
+		static:          map[[17]byte]bool{},
+		lighthouseHosts: lighthouseHosts,
+	}
+}
+
+func (lh *LightHouse) SetRemoteAllowList(allowList *AllowList) {
+	lh.remoteAllowList = allowList
+}
+
+func (lh *LightHouse) SetLocalAllowList(allowList *AllowList) {
+	lh.localAllowList = allowList
+}
+
+// AddRemote records addr as a place vpnIp can be reached. static marks the
+// entry as coming from static_host_map (as opposed to a handshake/query
+// response), which reload uses to tell which entries it's allowed to tear
+// down.
+func (lh *LightHouse) AddRemote(vpnIp VpnIp, addr *udpAddr, static bool) {
+	lh.Lock()
+	defer lh.Unlock()
+
+	key := vpnIp.Key()
+	lh.addrMap[key] = append(lh.addrMap[key], addr)
+	if static {
+		lh.static[key] = true
+	}
+}
+
+// QueryCache returns the known remote addresses for vpnIp, if any.
+func (lh *LightHouse) QueryCache(vpnIp VpnIp) []*udpAddr {
+	lh.RLock()
+	defer lh.RUnlock()
+	return lh.addrMap[vpnIp.Key()]
+}
+
+// IsLighthouseIP reports whether vpnIp is one of our configured upstream
+// lighthouses.
+func (lh *LightHouse) IsLighthouseIP(vpnIp VpnIp) bool {
+	for _, h := range lh.lighthouseHosts {
+		if h.Key() == vpnIp.Key() {
+			return true
+		}
+	}
+	return false
+}
+
+// UpdateLighthouseHosts replaces the configured upstream lighthouse list,
+// used when lighthouse.hosts changes on reload.
+func (lh *LightHouse) UpdateLighthouseHosts(hosts []VpnIp) {
+	lh.Lock()
+	defer lh.Unlock()
+	lh.lighthouseHosts = hosts
+}
+
+// ValidateLHStaticEntries makes sure every configured upstream lighthouse
+// has at least one known remote address, returning an error describing the
+// ones that don't.
+func (lh *LightHouse) ValidateLHStaticEntries() error {
+	lh.RLock()
+	defer lh.RUnlock()
+
+	var unreachable []VpnIp
+	for _, h := range lh.lighthouseHosts {
+		if len(lh.addrMap[h.Key()]) == 0 {
+			unreachable = append(unreachable, h)
+		}
+	}
+	if len(unreachable) > 0 {
+		return &lighthouseUnreachableError{hosts: unreachable}
+	}
+	return nil
+}
+
+type lighthouseUnreachableError struct {
+	hosts []VpnIp
+}
+
+func (e *lighthouseUnreachableError) Error() string {
+	msg := "no known address for lighthouse"
+	if len(e.hosts) != 1 {
+		msg += "es"
+	}
+	for i, h := range e.hosts {
+		if i > 0 {
+			msg += ","
+		}
+		msg += " " + h.String()
+	}
+	return msg
+}
+
+// LhUpdateWorker ticks every lighthouse.interval seconds on a
+// non-lighthouse node and logs a debug line for each upstream lighthouse.
+// It sends no update packet to them.
+func (lh *LightHouse) LhUpdateWorker(ifce *Interface) {
+	if lh.amLighthouse || lh.interval <= 0 {
+		return
+	}
+
+	clockSource := time.NewTicker(time.Second * time.Duration(lh.interval))
+	defer clockSource.Stop()
+	for range clockSource.C {
+		lh.RLock()
+		hosts := lh.lighthouseHosts
+		lh.RUnlock()
+
+		for _, h := range hosts {
+			l.WithField("lighthouse", h).Debug("Sending lighthouse update")
+		}
+	}
+}
@@ -8,10 +8,6 @@ import (
 	"gopkg.in/yaml.v2"
 	"net"
 	"os"
-	"os/signal"
-	"strconv"
-	"strings"
-	"syscall"
 	"time"
 )
 
@@ -19,18 +15,13 @@ var l = logrus.New()
 
 type m map[string]interface{}
 
-type CommandRequest struct {
-	Command string
-	Callback chan error
-}
-
-func Main(config *Config, configTest bool, block bool, buildVersion string, logFile string, tunFd *int, commandChan <-chan CommandRequest) error {
+func Main(config *Config, configTest bool, buildVersion string, logFile string, tunFd *int) (*Control, error) {
 	if logFile == "" {
 		l.Out = os.Stdout
 	} else {
 		f, err := os.OpenFile(logFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		l.SetOutput(f)
 	}
@@ -43,7 +34,7 @@ func Main(config *Config, configTest bool, block bool, buildVersion string, logF
 	if configTest {
 		b, err := yaml.Marshal(config.Settings)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		// Print the final config
@@ -52,7 +43,7 @@ func Main(config *Config, configTest bool, block bool, buildVersion string, logF
 
 	err := configLogger(config)
 	if err != nil {
-		return fmt.Errorf("failed to configure the logger: %s", err)
+		return nil, fmt.Errorf("failed to configure the logger: %s", err)
 	}
 
 	config.RegisterReloadCallback(func(c *Config) {
@@ -66,32 +57,36 @@ func Main(config *Config, configTest bool, block bool, buildVersion string, logF
 	trustedCAs, err = loadCAFromConfig(config)
 	if err != nil {
 		//The errors coming out of loadCA are already nicely formatted
-		return fmt.Errorf("failed to load ca from config: %s", err)
+		return nil, fmt.Errorf("failed to load ca from config: %s", err)
 	}
 	l.WithField("fingerprints", trustedCAs.GetFingerprints()).Debug("Trusted CA fingerprints")
 
 	cs, err := NewCertStateFromConfig(config)
 	if err != nil {
 		//The errors coming out of NewCertStateFromConfig are already nicely formatted
-		return fmt.Errorf("failed to load certificate from config: %s", err)
+		return nil, fmt.Errorf("failed to load certificate from config: %s", err)
 	}
 	l.WithField("cert", cs.certificate).Debug("Client nebula certificate")
 
 	fw, err := NewFirewallFromConfig(cs.certificate, config)
 	if err != nil {
-		return fmt.Errorf("error while loading firewall rules: %s", err)
+		return nil, fmt.Errorf("error while loading firewall rules: %s", err)
 	}
 	l.WithField("firewallHash", fw.GetRuleHash()).Info("Firewall started")
 
 	// TODO: make sure mask is 4 bytes
-	tunCidr := cs.certificate.Details.Ips[0]
+	// tunCidrs holds every address family a node presents, in certificate
+	// order. tunCidr remains the primary (first) address for code paths
+	// that haven't been generalized to dual-stack yet.
+	tunCidrs := cs.certificate.Details.Ips
+	tunCidr := tunCidrs[0]
 	routes, err := parseRoutes(config, tunCidr)
 	if err != nil {
-		return fmt.Errorf("could not parse tun.routes: %s", err)
+		return nil, fmt.Errorf("could not parse tun.routes: %s", err)
 	}
 	unsafeRoutes, err := parseUnsafeRoutes(config, tunCidr)
 	if err != nil {
-		return fmt.Errorf("could not parse tun.unsafe_routes: %s", err)
+		return nil, fmt.Errorf("could not parse tun.unsafe_routes: %s", err)
 	}
 
 	ssh, err := sshd.NewSSHServer(l.WithField("subsystem", "sshd"))
@@ -99,7 +94,7 @@ func Main(config *Config, configTest bool, block bool, buildVersion string, logF
 	if config.GetBool("sshd.enabled", false) {
 		err = configSSH(ssh, config)
 		if err != nil {
-			return fmt.Errorf("error while configuring the sshd: %s", err)
+			return nil, fmt.Errorf("error while configuring the sshd: %s", err)
 		}
 	}
 
@@ -113,7 +108,7 @@ func Main(config *Config, configTest bool, block bool, buildVersion string, logF
 		if tunFd != nil {
 			tun, err = newTunFromFd(
 				*tunFd,
-				tunCidr,
+				tunCidrs,
 				config.GetInt("tun.mtu", DEFAULT_MTU),
 				routes,
 				unsafeRoutes,
@@ -122,7 +117,7 @@ func Main(config *Config, configTest bool, block bool, buildVersion string, logF
 		} else {
 			tun, err = newTun(
 				config.GetString("tun.dev", ""),
-				tunCidr,
+				tunCidrs,
 				config.GetInt("tun.mtu", DEFAULT_MTU),
 				routes,
 				unsafeRoutes,
@@ -131,7 +126,7 @@ func Main(config *Config, configTest bool, block bool, buildVersion string, logF
 		}
 
 		if err != nil {
-			return fmt.Errorf("failed to get a tun/tap device: %s", err)
+			return nil, fmt.Errorf("failed to get a tun/tap device: %s", err)
 		}
 	}
 
@@ -142,28 +137,11 @@ func Main(config *Config, configTest bool, block bool, buildVersion string, logF
 	if !configTest {
 		udpServer, err = NewListener(config.GetString("listen.host", "0.0.0.0"), config.GetInt("listen.port", 0), udpQueues > 1)
 		if err != nil {
-			return fmt.Errorf("failed to open udp listener: %s", err)
+			return nil, fmt.Errorf("failed to open udp listener: %s", err)
 		}
 		udpServer.reloadConfig(config)
 	}
 
-	sigChan := make(chan os.Signal)
-	killChan := make(chan CommandRequest)
-	if commandChan != nil {
-		go func() {
-			cmd := CommandRequest{}
-			for {
-				cmd = <-commandChan
-				switch cmd.Command {
-				case "rebind":
-					udpServer.Rebind()
-				case "exit":
-					killChan <- cmd
-				}
-			}
-		}()
-	}
-
 	// Set up my internal host map
 	var preferredRanges []*net.IPNet
 	rawPreferredRanges := config.GetStringSlice("preferred_ranges", []string{})
@@ -172,7 +150,7 @@ func Main(config *Config, configTest bool, block bool, buildVersion string, logF
 		for _, rawPreferredRange := range rawPreferredRanges {
 			_, preferredRange, err := net.ParseCIDR(rawPreferredRange)
 			if err != nil {
-				return fmt.Errorf("failed to parse preferred_ranges: %s", err)
+				return nil, fmt.Errorf("failed to parse preferred_ranges: %s", err)
 			}
 			preferredRanges = append(preferredRanges, preferredRange)
 		}
@@ -185,7 +163,7 @@ func Main(config *Config, configTest bool, block bool, buildVersion string, logF
 	if rawLocalRange != "" {
 		_, localRange, err := net.ParseCIDR(rawLocalRange)
 		if err != nil {
-			return fmt.Errorf("failed to parse local_range: %s", err)
+			return nil, fmt.Errorf("failed to parse local_range: %s", err)
 		}
 
 		// Check if the entry for local_range was already specified in
@@ -202,7 +180,7 @@ func Main(config *Config, configTest bool, block bool, buildVersion string, logF
 		}
 	}
 
-	hostMap := NewHostMap("main", tunCidr, preferredRanges)
+	hostMap := NewHostMap("main", tunCidrs, preferredRanges)
 	hostMap.SetDefaultRoute(ip2int(net.ParseIP(config.GetString("default_route", "0.0.0.0"))))
 	hostMap.addUnsafeRoutes(&unsafeRoutes)
 
@@ -224,7 +202,7 @@ func Main(config *Config, configTest bool, block bool, buildVersion string, logF
 	if port == 0 && !configTest {
 		uPort, err := udpServer.LocalAddr()
 		if err != nil {
-			return fmt.Errorf("failed to get listening port: %s", err)
+			return nil, fmt.Errorf("failed to get listening port: %s", err)
 		}
 		port = int(uPort.Port)
 	}
@@ -237,21 +215,21 @@ func Main(config *Config, configTest bool, block bool, buildVersion string, logF
 		l.Warn("lighthouse.am_lighthouse enabled on node but upstream lighthouses exist in config")
 	}
 
-	lighthouseHosts := make([]uint32, len(rawLighthouseHosts))
+	lighthouseHosts := make([]VpnIp, len(rawLighthouseHosts))
 	for i, host := range rawLighthouseHosts {
 		ip := net.ParseIP(host)
 		if ip == nil {
 			l.WithField("host", host).Errorf("Unable to parse lighthouse host entry %v", i+1)
 		}
-		if !tunCidr.Contains(ip) {
+		if !vpnIpInSubnets(ip, tunCidrs) {
 			l.WithField("vpnIp", ip).WithField("network", tunCidr.String()).Fatalf("lighthouse host is not in our subnet, invalid")
 		}
-		lighthouseHosts[i] = ip2int(ip)
+		lighthouseHosts[i] = NewVpnIp(ip)
 	}
 
 	lightHouse := NewLightHouse(
 		amLighthouse,
-		ip2int(tunCidr.IP),
+		NewVpnIp(tunCidr.IP),
 		lighthouseHosts,
 		//TODO: change to a duration
 		config.GetInt("lighthouse.interval", 10),
@@ -273,38 +251,14 @@ func Main(config *Config, configTest bool, block bool, buildVersion string, logF
 	}
 	lightHouse.SetLocalAllowList(localAllowList)
 
-	//TODO: Move all of this inside functions in lighthouse.go
-	for k, v := range config.GetMap("static_host_map", map[interface{}]interface{}{}) {
-		vpnIp := net.ParseIP(fmt.Sprintf("%v", k))
-		if !tunCidr.Contains(vpnIp) {
-			l.WithField("vpnIp", vpnIp).WithField("network", tunCidr.String()).Fatalf("static_host_map key is not in our subnet, invalid")
+	for rawVpnIp, addrs := range parseStaticHostMap(config) {
+		vpnIpRaw := net.ParseIP(rawVpnIp)
+		if !vpnIpInSubnets(vpnIpRaw, tunCidrs) {
+			l.WithField("vpnIp", vpnIpRaw).WithField("network", tunCidr.String()).Fatalf("static_host_map key is not in our subnet, invalid")
 		}
-		vals, ok := v.([]interface{})
-		if ok {
-			for _, v := range vals {
-				parts := strings.Split(fmt.Sprintf("%v", v), ":")
-				addr, err := net.ResolveIPAddr("ip", parts[0])
-				if err == nil {
-					ip := addr.IP
-					port, err := strconv.Atoi(parts[1])
-					if err != nil {
-						l.Errorf("Static host address for %s could not be parsed: %s", vpnIp, v)
-					}
-					lightHouse.AddRemote(ip2int(vpnIp), NewUDPAddr(ip2int(ip), uint16(port)), true)
-				}
-			}
-		} else {
-			//TODO: make this all a helper
-			parts := strings.Split(fmt.Sprintf("%v", v), ":")
-			addr, err := net.ResolveIPAddr("ip", parts[0])
-			if err == nil {
-				ip := addr.IP
-				port, err := strconv.Atoi(parts[1])
-				if err != nil {
-					l.Errorf("Static host address for %s could not be parsed: %s", vpnIp, v)
-				}
-				lightHouse.AddRemote(ip2int(vpnIp), NewUDPAddr(ip2int(ip), uint16(port)), true)
-			}
+		vpnIp := NewVpnIp(vpnIpRaw)
+		for _, addr := range addrs {
+			lightHouse.AddRemote(vpnIp, addr, true)
 		}
 	}
 
@@ -358,13 +312,19 @@ func Main(config *Config, configTest bool, block bool, buildVersion string, logF
 	if !configTest {
 		ifce, err = NewInterface(ifConfig)
 		if err != nil {
-			return fmt.Errorf("failed to initialize interface: %s", err)
+			return nil, fmt.Errorf("failed to initialize interface: %s", err)
 		}
 
 		ifce.RegisterConfigChangeCallbacks(config)
 
 		go handshakeManager.Run(ifce)
 		go lightHouse.LhUpdateWorker(ifce)
+
+		// wireMainReload needs ifce so that a static_host_map reload can
+		// send a closeTunnel message to the remote side of a removed
+		// entry, the same way Control.CloseTunnel does, so it has to wait
+		// until the interface exists.
+		wireMainReload(config, udpServer, tun, tunCidr, tunCidrs, hostMap, lightHouse, handshakeManager, ifce)
 	}
 
 	err = startStats(config, configTest)
@@ -388,48 +348,14 @@ func Main(config *Config, configTest bool, block bool, buildVersion string, logF
 		go dnsMain(hostMap, config)
 	}
 
-	if block {
-		// Just sit here and be friendly, main thread.
-		shutdownBlock(ifce, sigChan, killChan)
-	} else {
-		// Even though we aren't blocking we still want to shutdown gracefully
-		go shutdownBlock(ifce, sigChan, killChan)
-	}
-	return nil
-}
-
-func shutdownBlock(ifce *Interface, sigChan chan os.Signal, killChan chan CommandRequest) {
-	var cmd CommandRequest
-	var sig string
+	control := newControl(ifce, config)
 
-	signal.Notify(sigChan, syscall.SIGTERM)
-	signal.Notify(sigChan, syscall.SIGINT)
-
-	select {
-		case rawSig := <-sigChan:
-			sig = rawSig.String()
-		case cmd = <-killChan:
-			sig = "controlling app"
-	}
-
-	l.WithField("signal", sig).Info("Caught signal, shutting down")
-
-	//TODO: stop tun and udp routines, the lock on hostMap effectively does that though
-	//TODO: this is probably better as a function in ConnectionManager or HostMap directly
-	ifce.hostMap.Lock()
-	for _, h := range ifce.hostMap.Hosts {
-		if h.ConnectionState.ready {
-			ifce.send(closeTunnel, 0, h.ConnectionState, h, h.remote, []byte{}, make([]byte, 12, 12), make([]byte, mtu))
-			l.WithField("vpnIp", IntIp(h.hostId)).WithField("udpAddr", h.remote).
-				Debug("Sending close tunnel message")
+	controlSockPath := config.GetString("control_sock.path", "")
+	if controlSockPath != "" {
+		if err := control.ListenControlSocket(controlSockPath); err != nil {
+			return nil, fmt.Errorf("failed to start control socket: %s", err)
 		}
 	}
-	ifce.hostMap.Unlock()
 
-	l.WithField("signal", sig).Info("Goodbye")
-	if cmd.Callback != nil {
-		select {
-			case cmd.Callback <- nil:
-		}
-	}
+	return control, nil
 }
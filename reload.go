@@ -0,0 +1,206 @@
+package nebula
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// parseStaticHostMap parses the static_host_map config block into the raw
+// vpn IP text each entry was keyed under and the remote addresses it asks
+// for. It does not validate subnet membership since callers need to treat
+// an invalid entry differently at startup (fatal) than on reload (log and
+// skip the entry).
+func parseStaticHostMap(config *Config) map[string][]*udpAddr {
+	out := make(map[string][]*udpAddr)
+
+	for k, v := range config.GetMap("static_host_map", map[interface{}]interface{}{}) {
+		rawVpnIp := fmt.Sprintf("%v", k)
+
+		rawAddrs, ok := v.([]interface{})
+		if !ok {
+			rawAddrs = []interface{}{v}
+		}
+
+		for _, rawAddr := range rawAddrs {
+			parts := strings.Split(fmt.Sprintf("%v", rawAddr), ":")
+			if len(parts) != 2 {
+				l.Errorf("Static host address for %s could not be parsed: %s", rawVpnIp, rawAddr)
+				continue
+			}
+
+			addr, err := net.ResolveIPAddr("ip", parts[0])
+			if err != nil {
+				l.Errorf("Static host address for %s could not be parsed: %s", rawVpnIp, rawAddr)
+				continue
+			}
+
+			port, err := strconv.Atoi(parts[1])
+			if err != nil {
+				l.Errorf("Static host address for %s could not be parsed: %s", rawVpnIp, rawAddr)
+				continue
+			}
+
+			out[rawVpnIp] = append(out[rawVpnIp], NewUDPAddr(ip2int(addr.IP), uint16(port)))
+		}
+	}
+
+	return out
+}
+
+// wireMainReload hooks SIGHUP (via config.RegisterReloadCallback) so that
+// listen.host/listen.port, tun.routes/tun.unsafe_routes, lighthouse.hosts,
+// and static_host_map can be changed without restarting the process. Each
+// setting is diffed against what was last applied so an unrelated config
+// change doesn't cause us to rebind the listener or tear down unaffected
+// tunnels.
+func wireMainReload(
+	config *Config,
+	udpServer *udpConn,
+	tun *Tun,
+	tunCidr *net.IPNet,
+	tunCidrs []*net.IPNet,
+	hostMap *HostMap,
+	lightHouse *LightHouse,
+	handshakeManager *HandshakeManager,
+	ifce *Interface,
+) {
+	lastListenHost := config.GetString("listen.host", "0.0.0.0")
+	lastListenPort := config.GetInt("listen.port", 0)
+
+	lastRoutes, err := parseRoutes(config, tunCidr)
+	if err != nil {
+		// Main already validated this at startup, this should be unreachable.
+		l.WithError(err).Error("failed to parse tun.routes for reload tracking")
+	}
+	lastUnsafeRoutes, err := parseUnsafeRoutes(config, tunCidr)
+	if err != nil {
+		l.WithError(err).Error("failed to parse tun.unsafe_routes for reload tracking")
+	}
+
+	lastLighthouseHosts := config.GetStringSlice("lighthouse.hosts", []string{})
+	lastStaticHostMap := config.GetMap("static_host_map", map[interface{}]interface{}{})
+
+	config.RegisterReloadCallback(func(c *Config) {
+		host := c.GetString("listen.host", "0.0.0.0")
+		port := c.GetInt("listen.port", 0)
+		if host != lastListenHost || port != lastListenPort {
+			l.WithField("oldListen", fmt.Sprintf("%s:%d", lastListenHost, lastListenPort)).
+				WithField("newListen", fmt.Sprintf("%s:%d", host, port)).
+				Info("listen.host/listen.port changed, rebinding udp listener")
+
+			udpServer.reloadConfig(c)
+			udpServer.Rebind()
+			lastListenHost, lastListenPort = host, port
+		}
+
+		routes, err := parseRoutes(c, tunCidr)
+		if err != nil {
+			l.WithError(err).Error("could not parse tun.routes on reload, keeping previous routes")
+			routes = lastRoutes
+		}
+		unsafeRoutes, err := parseUnsafeRoutes(c, tunCidr)
+		if err != nil {
+			l.WithError(err).Error("could not parse tun.unsafe_routes on reload, keeping previous unsafe routes")
+			unsafeRoutes = lastUnsafeRoutes
+		}
+		if !reflect.DeepEqual(routes, lastRoutes) || !reflect.DeepEqual(unsafeRoutes, lastUnsafeRoutes) {
+			l.Info("tun.routes/tun.unsafe_routes changed, applying to tun device")
+			if err := tun.ReloadRoutes(routes, unsafeRoutes); err != nil {
+				l.WithError(err).Error("Failed to apply tun.routes/tun.unsafe_routes")
+			} else {
+				hostMap.Lock()
+				hostMap.addUnsafeRoutes(&unsafeRoutes)
+				hostMap.Unlock()
+				lastRoutes, lastUnsafeRoutes = routes, unsafeRoutes
+			}
+		}
+
+		lighthouseHosts := c.GetStringSlice("lighthouse.hosts", []string{})
+		if !reflect.DeepEqual(lighthouseHosts, lastLighthouseHosts) {
+			l.Info("lighthouse.hosts changed, updating lighthouse upstream list")
+			newHosts := make([]VpnIp, 0, len(lighthouseHosts))
+			for _, host := range lighthouseHosts {
+				ip := net.ParseIP(host)
+				if ip == nil || !vpnIpInSubnets(ip, tunCidrs) {
+					l.WithField("host", host).Error("Unable to reload invalid lighthouse host entry")
+					continue
+				}
+				newHosts = append(newHosts, NewVpnIp(ip))
+			}
+			lightHouse.UpdateLighthouseHosts(newHosts)
+			lastLighthouseHosts = lighthouseHosts
+		}
+
+		staticHostMap := c.GetMap("static_host_map", map[interface{}]interface{}{})
+		if !reflect.DeepEqual(staticHostMap, lastStaticHostMap) {
+			l.Info("static_host_map changed, reapplying static host entries")
+			reloadStaticHostMap(c, tunCidrs, lightHouse, hostMap, handshakeManager, ifce)
+			lastStaticHostMap = staticHostMap
+		}
+	})
+}
+
+// staticHostMapEntry pairs a parsed static_host_map vpn IP with the remote
+// addresses it was configured with, keyed by VpnIp.Key() so it can live in
+// a map (net.IP, and therefore VpnIp, is not itself comparable).
+type staticHostMapEntry struct {
+	vpnIp VpnIp
+	addrs []*udpAddr
+}
+
+// reloadStaticHostMap tears down handshake/hostmap state for any vpn IP that
+// was added from static_host_map and is no longer present in it, then re-applies the
+// current entries. Removed entries are torn down the same way
+// Control.CloseTunnel closes a tunnel: a closeTunnel message is sent to the
+// remote before the local hostmap/handshake state is dropped, so a reload
+// never leaves the peer believing a tunnel is still live when we've already
+// forgotten about it.
+func reloadStaticHostMap(
+	config *Config,
+	tunCidrs []*net.IPNet,
+	lightHouse *LightHouse,
+	hostMap *HostMap,
+	handshakeManager *HandshakeManager,
+	ifce *Interface,
+) {
+	current := make(map[[17]byte]staticHostMapEntry)
+	for rawVpnIp, addrs := range parseStaticHostMap(config) {
+		ip := net.ParseIP(rawVpnIp)
+		if ip == nil || !vpnIpInSubnets(ip, tunCidrs) {
+			l.WithField("vpnIp", rawVpnIp).Error("Unable to reload invalid static_host_map entry")
+			continue
+		}
+		vpnIp := NewVpnIp(ip)
+		current[vpnIp.Key()] = staticHostMapEntry{vpnIp: vpnIp, addrs: addrs}
+	}
+
+	hostMap.Lock()
+	for key, hostInfo := range hostMap.Hosts {
+		lightHouse.RLock()
+		wasStatic := lightHouse.static[key]
+		lightHouse.RUnlock()
+		if _, stillStatic := current[key]; !stillStatic && wasStatic {
+			if hostInfo.ConnectionState.ready {
+				ifce.send(closeTunnel, 0, hostInfo.ConnectionState, hostInfo, hostInfo.remote, []byte{}, make([]byte, 12, 12), make([]byte, mtu))
+				l.WithField("vpnIp", hostInfo.vpnIp).WithField("udpAddr", hostInfo.remote).
+					Debug("Sending close tunnel message for removed static_host_map entry")
+			}
+			hostMap.DeleteHostInfo(hostInfo)
+			handshakeManager.DeleteHostInfo(hostInfo.vpnIp)
+		}
+	}
+	hostMap.Unlock()
+
+	for _, entry := range current {
+		for _, addr := range entry.addrs {
+			lightHouse.AddRemote(entry.vpnIp, addr, true)
+		}
+	}
+
+	if err := lightHouse.ValidateLHStaticEntries(); err != nil {
+		l.WithError(err).Error("Lighthouse unreachable")
+	}
+}
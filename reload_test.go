@@ -0,0 +1,103 @@
+package nebula
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_parseStaticHostMap(t *testing.T) {
+	c := &Config{Settings: map[interface{}]interface{}{
+		"static_host_map": map[interface{}]interface{}{
+			"10.0.0.2": []interface{}{"1.2.3.4:4242"},
+			"10.0.0.3": "1.2.3.5:4242",
+		},
+	}}
+
+	hostMap := parseStaticHostMap(c)
+	assert.Len(t, hostMap, 2)
+	assert.Len(t, hostMap["10.0.0.2"], 1)
+	assert.Len(t, hostMap["10.0.0.3"], 1)
+
+	// A malformed entry is skipped rather than aborting the whole reload.
+	c = &Config{Settings: map[interface{}]interface{}{
+		"static_host_map": map[interface{}]interface{}{
+			"10.0.0.2": []interface{}{"not-an-addr"},
+		},
+	}}
+	assert.Empty(t, parseStaticHostMap(c))
+}
+
+// Test_reloadStaticHostMap exercises the diffing logic that backs SIGHUP
+// reload of static_host_map: an entry removed from config should be torn
+// down out of the live hostmap (and the handshake manager), while an entry
+// that is still present should be left alone.
+func Test_reloadStaticHostMap(t *testing.T) {
+	_, tunCidr, err := net.ParseCIDR("10.0.0.1/24")
+	assert.NoError(t, err)
+	tunCidrs := []*net.IPNet{tunCidr}
+
+	hostMap := NewHostMap("test", tunCidrs, nil)
+	lightHouse := NewLightHouse(false, NewVpnIp(net.ParseIP("10.0.0.1")), nil, 10, 0, nil, false, 0)
+	handshakeManager := NewHandshakeManager(tunCidr, nil, hostMap, lightHouse, nil, HandshakeConfig{})
+
+	keepIp := NewVpnIp(net.ParseIP("10.0.0.2"))
+	dropIp := NewVpnIp(net.ParseIP("10.0.0.3"))
+
+	for _, vpnIp := range []VpnIp{keepIp, dropIp} {
+		lightHouse.AddRemote(vpnIp, NewUDPAddr(ip2int(net.ParseIP("1.2.3.4")), 4242), true)
+	}
+
+	hostMap.Lock()
+	for _, vpnIp := range []VpnIp{keepIp, dropIp} {
+		hostMap.Hosts[vpnIp.Key()] = &HostInfo{
+			vpnIp:           vpnIp,
+			ConnectionState: &ConnectionState{},
+		}
+	}
+	hostMap.Unlock()
+
+	c := &Config{Settings: map[interface{}]interface{}{
+		"static_host_map": map[interface{}]interface{}{
+			"10.0.0.2": []interface{}{"1.2.3.4:4242"},
+		},
+	}}
+
+	reloadStaticHostMap(c, tunCidrs, lightHouse, hostMap, handshakeManager, nil)
+
+	hostMap.Lock()
+	_, stillPresent := hostMap.Hosts[keepIp.Key()]
+	_, dropStillPresent := hostMap.Hosts[dropIp.Key()]
+	hostMap.Unlock()
+
+	assert.True(t, stillPresent, "entry still in static_host_map should survive reload")
+	assert.False(t, dropStillPresent, "entry dropped from static_host_map should be torn down")
+}
+
+// Test_Tun_ReloadRoutes exercises the apply half of the tun.routes/
+// tun.unsafe_routes reload path that wireMainReload's diff drives: once a
+// changed route set is detected, ReloadRoutes is what actually swaps it
+// into the device. The diffing itself (and the listen.host/listen.port
+// rebind path) lives inside wireMainReload's RegisterReloadCallback
+// closure, which calls parseRoutes/parseUnsafeRoutes and drives a real
+// *udpConn - neither of which exists in this snapshot (no udp_<os>.go),
+// so that half can't be unit tested here without fabricating them.
+func Test_Tun_ReloadRoutes(t *testing.T) {
+	_, cidr, err := net.ParseCIDR("10.0.0.0/24")
+	assert.NoError(t, err)
+
+	tun, err := newTun("", []*net.IPNet{cidr}, DEFAULT_MTU, nil, nil, 0)
+	assert.NoError(t, err)
+	assert.Empty(t, tun.Routes)
+	assert.Empty(t, tun.UnsafeRoutes)
+
+	_, routeCidr, err := net.ParseCIDR("10.0.1.0/24")
+	assert.NoError(t, err)
+	routes := []Route{{Cidr: routeCidr, Metric: 100}}
+	unsafeRoutes := []Route{{Cidr: routeCidr, Metric: 200}}
+
+	assert.NoError(t, tun.ReloadRoutes(routes, unsafeRoutes))
+	assert.Equal(t, routes, tun.Routes)
+	assert.Equal(t, unsafeRoutes, tun.UnsafeRoutes)
+}
@@ -0,0 +1,59 @@
+package nebula
+
+import "net"
+
+// DEFAULT_MTU is used for tun.mtu when the config doesn't set one.
+const DEFAULT_MTU = 1300
+
+// Tun is the local OS tunnel device nebula reads decrypted packets from
+// and writes them to. Cidrs holds every tunnel address family the local
+// certificate presents (see VpnIp), so that routes and unsafe_routes can
+// be applied per address family instead of assuming IPv4. The actual
+// device I/O is platform specific and lives in tun_<os>.go files built on
+// top of this one; this file holds the cross-platform shape newTun,
+// newTunFromFd, and ReloadRoutes all agree on.
+type Tun struct {
+	Device       string
+	Cidrs        []*net.IPNet
+	MaxMTU       int
+	Routes       []Route
+	UnsafeRoutes []Route
+	TXQueueLen   int
+}
+
+// newTun returns a Tun holding the device name, cidrs, routes, and
+// unsafeRoutes. It does not open or configure an OS device.
+func newTun(deviceName string, cidrs []*net.IPNet, mtu int, routes []Route, unsafeRoutes []Route, txQueueLen int) (*Tun, error) {
+	return &Tun{
+		Device:       deviceName,
+		Cidrs:        cidrs,
+		MaxMTU:       mtu,
+		Routes:       routes,
+		UnsafeRoutes: unsafeRoutes,
+		TXQueueLen:   txQueueLen,
+	}, nil
+}
+
+// newTunFromFd is the entry point for an already-open tun file descriptor
+// (handed to us by a supervisor that manages tun creation itself, e.g. on
+// Android/iOS). It returns a Tun like newTun does; fd itself is not used.
+func newTunFromFd(fd int, cidrs []*net.IPNet, mtu int, routes []Route, unsafeRoutes []Route, txQueueLen int) (*Tun, error) {
+	return &Tun{
+		Cidrs:        cidrs,
+		MaxMTU:       mtu,
+		Routes:       routes,
+		UnsafeRoutes: unsafeRoutes,
+		TXQueueLen:   txQueueLen,
+	}, nil
+}
+
+// ReloadRoutes replaces the route/unsafe_route set applied to the device,
+// used on SIGHUP when tun.routes or tun.unsafe_routes changes. It replaces
+// the full set rather than diffing element by element since route tables
+// of this size are cheap to rebuild and it avoids reconciling partial
+// failures against whatever was there before.
+func (t *Tun) ReloadRoutes(routes []Route, unsafeRoutes []Route) error {
+	t.Routes = routes
+	t.UnsafeRoutes = unsafeRoutes
+	return nil
+}
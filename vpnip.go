@@ -0,0 +1,63 @@
+package nebula
+
+import "net"
+
+// VpnIp identifies a host by one of its tunnel addresses. It generalizes
+// the old bare uint32 (which could only ever hold an IPv4 address) to a
+// variable-length address so that IPv6 certificates can be used for
+// handshakes, hostmap lookups, and lighthouse queries the same way IPv4
+// ones are today.
+type VpnIp struct {
+	ip net.IP
+}
+
+// NewVpnIp wraps ip, normalizing IPv4 addresses to their 4 byte form so
+// that two VpnIps constructed from equivalent IPv4 representations
+// (4-byte vs 16-byte) compare and hash identically.
+func NewVpnIp(ip net.IP) VpnIp {
+	if v4 := ip.To4(); v4 != nil {
+		return VpnIp{ip: v4}
+	}
+	return VpnIp{ip: ip}
+}
+
+// String returns the standard text form of the wrapped address.
+func (v VpnIp) String() string {
+	return v.ip.String()
+}
+
+// IP returns the underlying net.IP.
+func (v VpnIp) IP() net.IP {
+	return v.ip
+}
+
+// Is4 reports whether this VpnIp holds an IPv4 address.
+func (v VpnIp) Is4() bool {
+	return v.ip.To4() != nil
+}
+
+// Key returns a comparable, fixed-size representation suitable for use as
+// a map key, since net.IP (a []byte) is not itself comparable. The first
+// byte tags the length of the wrapped address (4 or 16) before the
+// zero-padded address bytes, so a 4-byte IPv4 address and a 16-byte
+// address that happens to zero-pad to the same bytes - e.g. the deprecated
+// IPv4-compatible IPv6 literal ::1.2.3.4, which net.IP.To4() does not
+// collapse the way it does ::ffff:1.2.3.4 - never produce the same key.
+func (v VpnIp) Key() [17]byte {
+	var k [17]byte
+	k[0] = byte(len(v.ip))
+	copy(k[17-len(v.ip):], v.ip)
+	return k
+}
+
+// vpnIpInSubnets reports whether ip falls within any of the given subnets,
+// used wherever a single tunCidr.Contains(ip) check used to be enough
+// before nodes could present more than one tunnel address.
+func vpnIpInSubnets(ip net.IP, subnets []*net.IPNet) bool {
+	for _, subnet := range subnets {
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}